@@ -0,0 +1,242 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-memory implementation of vault.Client backed
+// by an in-process CA, so that tests can exercise Vault-issued
+// CertificateRequests without talking to a live Vault server.
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	internalvault "github.com/jetstack/cert-manager/pkg/internal/vault"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+)
+
+var _ internalvault.Client = &Client{}
+
+// Client is a fake implementation of internalvault.Client that signs CSRs
+// against an in-process CA instead of a real Vault PKI secrets engine. It
+// services the two requests the issuer actually makes: AppRole login, and
+// signing under a "/sign/" PKI role.
+type Client struct {
+	caCert    *x509.Certificate
+	caCertPEM []byte
+	caKey     *rsa.PrivateKey
+
+	token string
+}
+
+// New generates a fresh self-signed CA and returns a Client that signs
+// against it.
+func New() (*Client, error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating fake CA key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake-vault-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour * 365),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("error self-signing fake CA certificate: %s", err.Error())
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fake CA certificate: %s", err.Error())
+	}
+
+	caCertPEM, err := pki.EncodeX509(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding fake CA certificate: %s", err.Error())
+	}
+
+	return &Client{
+		caCert:    caCert,
+		caCertPEM: caCertPEM,
+		caKey:     caKey,
+	}, nil
+}
+
+// NewClientBuilder returns a VaultClientBuilder whose Vault.Sign calls are
+// serviced by a fresh fake CA, for wiring into tests in place of vault.New.
+func NewClientBuilder() internalvault.VaultClientBuilder {
+	return func(namespace string, secretsLister corelisters.SecretLister,
+		issuer v1alpha2.GenericIssuer) (internalvault.Interface, error) {
+		client, err := New()
+		if err != nil {
+			return nil, err
+		}
+
+		return internalvault.NewWithClient(namespace, secretsLister, issuer, client)
+	}
+}
+
+func (c *Client) NewRequest(method, requestPath string) *vault.Request {
+	return &vault.Request{
+		Method: method,
+		// ToHTTP (called from RawRequest below, via r.ToHTTP()) dereferences
+		// URL to encode Params into its query string, so this must be
+		// non-nil even though we never actually send the request anywhere;
+		// we short-circuit in RawRequest and only need the request path,
+		// stashed in a header, to dispatch on below.
+		URL:    &url.URL{Path: requestPath},
+		Params: make(map[string][]string),
+		Headers: http.Header{
+			"X-Fake-Vault-Path": []string{requestPath},
+		},
+	}
+}
+
+func (c *Client) RawRequest(r *vault.Request) (*vault.Response, error) {
+	requestPath := r.Headers.Get("X-Fake-Vault-Path")
+
+	httpReq, err := r.ToHTTP()
+	if err != nil {
+		return nil, fmt.Errorf("fake vault client: error building http request: %s", err.Error())
+	}
+
+	rec := httptest.NewRecorder()
+
+	switch {
+	case strings.HasSuffix(requestPath, "/auth/approle/login"):
+		c.handleAppRoleLogin(rec, httpReq)
+	case strings.Contains(requestPath, "/sign/"):
+		c.handleSign(rec, httpReq)
+	default:
+		return nil, fmt.Errorf("fake vault client: unsupported request path %q", requestPath)
+	}
+
+	resp := rec.Result()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("fake vault server returned %d", resp.StatusCode)
+	}
+
+	return &vault.Response{Response: resp}, nil
+}
+
+func (c *Client) handleAppRoleLogin(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   "fake-vault-token",
+			"lease_duration": 3600,
+			"renewable":      true,
+		},
+	})
+}
+
+func (c *Client) handleSign(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		CSR string `json:"csr"`
+		TTL string `json:"ttl"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, fmt.Sprintf("error decoding sign request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	csr, err := pki.DecodeX509CertificateRequestBytes([]byte(params.CSR))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error decoding CSR: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	duration, err := time.ParseDuration(params.TTL)
+	if err != nil || duration <= 0 {
+		duration = time.Hour * 24 * 90
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(time.Now().UnixNano()),
+		Subject:            csr.Subject,
+		DNSNames:           csr.DNSNames,
+		IPAddresses:        csr.IPAddresses,
+		URIs:               csr.URIs,
+		NotBefore:          time.Now().Add(-time.Minute),
+		NotAfter:           time.Now().Add(duration),
+		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, c.caCert, csr.PublicKey, c.caKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error signing certificate: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing signed certificate: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	certPEM, err := pki.EncodeX509(cert)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error encoding signed certificate: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{
+			"certificate": string(certPEM),
+			"issuing_ca":  string(c.caCertPEM),
+			"ca_chain":    []string{string(c.caCertPEM)},
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+func (c *Client) Token() string {
+	return c.token
+}
+
+func (c *Client) Sys() *vault.Sys {
+	return nil
+}
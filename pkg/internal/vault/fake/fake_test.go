@@ -0,0 +1,94 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+)
+
+// TestClientRawRequest guards against a regression where NewRequest built a
+// *vault.Request with a nil URL: RawRequest's call to r.ToHTTP() dereferences
+// it (via toRetryableHTTP encoding Params into the URL's query string), so
+// every request the fake services - AppRole login included - panicked
+// before ever reaching handleAppRoleLogin/handleSign.
+func TestClientRawRequest(t *testing.T) {
+	tests := map[string]struct {
+		requestPath string
+		body        interface{}
+	}{
+		"approle login": {
+			requestPath: "/v1/auth/approle/login",
+			body:        map[string]string{"role_id": "role", "secret_id": "secret"},
+		},
+		"pki sign": {
+			requestPath: "/v1/pki/sign/example-dot-com",
+			body:        map[string]string{"csr": string(generateTestCSRPEM(t)), "ttl": "24h"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, err := New()
+			if err != nil {
+				t.Fatalf("failed to construct fake client: %s", err)
+			}
+
+			request := client.NewRequest("POST", test.requestPath)
+			if err := request.SetJSONBody(test.body); err != nil {
+				t.Fatalf("failed to set request body: %s", err)
+			}
+
+			resp, err := client.RawRequest(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer resp.Body.Close()
+
+			var decoded map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+				t.Fatalf("failed to decode response body: %s", err)
+			}
+			if len(decoded) == 0 {
+				t.Error("expected a non-empty response body")
+			}
+		})
+	}
+}
+
+func generateTestCSRPEM(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %s", err)
+	}
+
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "fake-client-test"}}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("failed to create test CSR: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+}
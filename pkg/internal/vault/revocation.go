@@ -0,0 +1,291 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+)
+
+// TidyAnnotationKey, when set to "true" on the Issuer/ClusterIssuer resource,
+// causes the next CRL refresh tick to also trigger Vault's tidy operation on
+// the PKI mount, sweeping expired certificate serials out of storage.
+const TidyAnnotationKey = "cert-manager.io/vault-tidy"
+
+// defaultCRLRefreshInterval is used when the issuer spec does not configure
+// Vault.CRLConfig.RefreshInterval.
+const defaultCRLRefreshInterval = time.Hour
+
+// RevocationController republishes the CRL served by a Vault issuer's PKI
+// mount into a ConfigMap or Secret on a fixed interval, and revokes
+// certificates by serial number when a CertificateRequest referencing this
+// issuer is deleted.
+type RevocationController struct {
+	vault      Interface
+	kubeClient kubernetes.Interface
+	issuer     v1alpha2.GenericIssuer
+	namespace  string
+
+	// crInformer is watched for CertificateRequest deletions so the
+	// corresponding certificate can be revoked in Vault.
+	crInformer cache.SharedIndexInformer
+}
+
+// NewRevocationController constructs a RevocationController for the given
+// issuer. vault is normally the Interface returned by New for the same
+// issuer, so that CRL fetches and revocations share the authenticated
+// client and its cached token. crInformer is the CertificateRequest
+// informer for the issuer's namespace; Run registers a delete handler on it.
+func NewRevocationController(kubeClient kubernetes.Interface, namespace string, issuer v1alpha2.GenericIssuer, vault Interface, crInformer cache.SharedIndexInformer) *RevocationController {
+	return &RevocationController{
+		vault:      vault,
+		kubeClient: kubeClient,
+		issuer:     issuer,
+		namespace:  namespace,
+		crInformer: crInformer,
+	}
+}
+
+// Run registers the CertificateRequest delete handler and starts the
+// periodic CRL refresh loop. It blocks until stopCh is closed, so callers
+// should invoke it in its own goroutine.
+func (c *RevocationController) Run(stopCh <-chan struct{}) {
+	c.crInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.handleCertificateRequestDelete,
+	})
+
+	interval := defaultCRLRefreshInterval
+	if crlConfig := c.issuer.GetSpec().Vault.CRLConfig; crlConfig != nil && crlConfig.RefreshInterval.Duration > 0 {
+		interval = crlConfig.RefreshInterval.Duration
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				klog.Errorf("error refreshing Vault CRL for issuer %q: %s", c.issuer.GetObjectMeta().Name, err.Error())
+			}
+		}
+	}
+}
+
+// handleCertificateRequestDelete revokes the certificate backing a deleted
+// CertificateRequest, provided it was issued through this controller's
+// issuer. Requests for other issuers in the same namespace are ignored.
+func (c *RevocationController) handleCertificateRequestDelete(obj interface{}) {
+	cr, ok := obj.(*v1alpha2.CertificateRequest)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			klog.Errorf("couldn't get object from tombstone %#v", obj)
+			return
+		}
+		cr, ok = tombstone.Obj.(*v1alpha2.CertificateRequest)
+		if !ok {
+			klog.Errorf("tombstone contained object that is not a CertificateRequest: %#v", tombstone.Obj)
+			return
+		}
+	}
+
+	if cr.Namespace != c.namespace || cr.Spec.IssuerRef.Name != c.issuer.GetObjectMeta().Name {
+		return
+	}
+
+	serial, err := serialFromCertificateRequest(cr)
+	if err != nil {
+		klog.Errorf("error reading serial number from deleted CertificateRequest %q: %s", cr.Name, err.Error())
+		return
+	}
+	if serial == "" {
+		return
+	}
+
+	if err := c.RevokeCertificateRequest(serial); err != nil {
+		klog.Errorf("error revoking certificate for deleted CertificateRequest %q: %s", cr.Name, err.Error())
+	}
+}
+
+// serialFromCertificateRequest reads the colon-separated hex serial number
+// of the certificate issued for cr, or "" if it was deleted before issuance
+// completed.
+func serialFromCertificateRequest(cr *v1alpha2.CertificateRequest) (string, error) {
+	if len(cr.Status.Certificate) == 0 {
+		return "", nil
+	}
+
+	block, _ := pem.Decode(cr.Status.Certificate)
+	if block == nil {
+		return "", fmt.Errorf("failed to decode PEM certificate on CertificateRequest %q", cr.Name)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate on CertificateRequest %q: %s", cr.Name, err.Error())
+	}
+
+	return formatSerial(cert.SerialNumber), nil
+}
+
+// formatSerial renders a certificate serial number the way Vault's revoke
+// endpoint expects it: lowercase hex octets separated by colons.
+func formatSerial(serial *big.Int) string {
+	raw := serial.Bytes()
+	parts := make([]string, len(raw))
+	for i, b := range raw {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// refresh fetches the current CRL and republishes it, then runs Vault's
+// tidy operation if the issuer is annotated to request it.
+func (c *RevocationController) refresh() error {
+	if err := c.refreshCRL(); err != nil {
+		return err
+	}
+
+	if c.issuer.GetObjectMeta().Annotations[TidyAnnotationKey] == "true" {
+		if err := c.vault.Tidy(); err != nil {
+			return fmt.Errorf("error running Vault tidy: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// refreshCRL fetches the current CRL from vault and republishes it into
+// whichever of Vault.CRLConfig.SecretRef/ConfigMapRef is configured,
+// creating the target object if it doesn't already exist.
+func (c *RevocationController) refreshCRL() error {
+	crlConfig := c.issuer.GetSpec().Vault.CRLConfig
+	if crlConfig == nil {
+		return nil
+	}
+
+	crl, err := c.vault.FetchCRL()
+	if err != nil {
+		return fmt.Errorf("error fetching CRL from vault: %s", err.Error())
+	}
+
+	switch {
+	case crlConfig.SecretRef.Name != "":
+		return c.publishCRLToSecret(crlConfig.SecretRef, crl)
+	case crlConfig.ConfigMapRef.Name != "":
+		return c.publishCRLToConfigMap(crlConfig.ConfigMapRef, crl)
+	default:
+		return nil
+	}
+}
+
+func (c *RevocationController) publishCRLToSecret(ref cmmeta.SecretKeySelector, crl []byte) error {
+	key := ref.Key
+	if key == "" {
+		key = "crl.der"
+	}
+
+	secrets := c.kubeClient.CoreV1().Secrets(c.namespace)
+
+	secret, err := secrets.Get(ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err := secrets.Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: c.namespace},
+			Data:       map[string][]byte{key: crl},
+		})
+		if err != nil {
+			return fmt.Errorf("error creating CRL secret '%s/%s': %s", c.namespace, ref.Name, err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching CRL secret '%s/%s': %s", c.namespace, ref.Name, err.Error())
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[key] = crl
+
+	if _, err := secrets.Update(secret); err != nil {
+		return fmt.Errorf("error updating CRL secret '%s/%s': %s", c.namespace, ref.Name, err.Error())
+	}
+
+	return nil
+}
+
+func (c *RevocationController) publishCRLToConfigMap(ref cmmeta.SecretKeySelector, crl []byte) error {
+	key := ref.Key
+	if key == "" {
+		key = "crl.der"
+	}
+
+	configMaps := c.kubeClient.CoreV1().ConfigMaps(c.namespace)
+
+	configMap, err := configMaps.Get(ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err := configMaps.Create(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: c.namespace},
+			BinaryData: map[string][]byte{key: crl},
+		})
+		if err != nil {
+			return fmt.Errorf("error creating CRL configmap '%s/%s': %s", c.namespace, ref.Name, err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching CRL configmap '%s/%s': %s", c.namespace, ref.Name, err.Error())
+	}
+
+	if configMap.BinaryData == nil {
+		configMap.BinaryData = map[string][]byte{}
+	}
+	configMap.BinaryData[key] = crl
+
+	if _, err := configMaps.Update(configMap); err != nil {
+		return fmt.Errorf("error updating CRL configmap '%s/%s': %s", c.namespace, ref.Name, err.Error())
+	}
+
+	return nil
+}
+
+// RevokeCertificateRequest revokes the certificate issued for a deleted
+// CertificateRequest by its serial number.
+func (c *RevocationController) RevokeCertificateRequest(serial string) error {
+	if err := c.vault.Revoke(serial); err != nil {
+		return fmt.Errorf("error revoking certificate %q in vault: %s", serial, err.Error())
+	}
+
+	return nil
+}
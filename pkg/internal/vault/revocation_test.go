@@ -0,0 +1,317 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+)
+
+// fakeInterface is a minimal Interface double for exercising
+// RevocationController without a real Vault server or the fake PKI Client.
+type fakeInterface struct {
+	crl       []byte
+	fetchErr  error
+	revokeErr error
+
+	revokedSerials []string
+}
+
+func (f *fakeInterface) Sign(_ []byte, _ time.Duration) ([]byte, []byte, error) {
+	return nil, nil, errors.New("not implemented")
+}
+
+func (f *fakeInterface) Revoke(serial string) error {
+	f.revokedSerials = append(f.revokedSerials, serial)
+	return f.revokeErr
+}
+
+func (f *fakeInterface) FetchCRL() ([]byte, error) {
+	return f.crl, f.fetchErr
+}
+
+func (f *fakeInterface) Tidy() error {
+	return nil
+}
+
+func (f *fakeInterface) Sys() *vaultapi.Sys {
+	return nil
+}
+
+func issuerWithCRLConfig(crlConfig *v1alpha2.VaultCRLConfig) v1alpha2.GenericIssuer {
+	return &v1alpha2.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-issuer"},
+		Spec: v1alpha2.IssuerSpec{
+			IssuerConfig: v1alpha2.IssuerConfig{
+				Vault: &v1alpha2.VaultIssuer{CRLConfig: crlConfig},
+			},
+		},
+	}
+}
+
+func TestRefreshCRL(t *testing.T) {
+	const crlKey = "crl.der"
+	crl := []byte("fake-crl-bytes")
+
+	tests := map[string]struct {
+		crlConfig      *v1alpha2.VaultCRLConfig
+		existingObject interface{}
+		fetchErr       error
+		wantErr        bool
+		wantNoop       bool
+	}{
+		"no CRLConfig is a no-op": {
+			crlConfig: nil,
+			wantNoop:  true,
+		},
+		"creates the Secret when it does not exist": {
+			crlConfig: &v1alpha2.VaultCRLConfig{
+				SecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "crl-secret"},
+					Key:                  crlKey,
+				},
+			},
+		},
+		"updates an existing Secret": {
+			crlConfig: &v1alpha2.VaultCRLConfig{
+				SecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "crl-secret"},
+					Key:                  crlKey,
+				},
+			},
+			existingObject: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "crl-secret"},
+				Data:       map[string][]byte{crlKey: []byte("stale")},
+			},
+		},
+		"creates the ConfigMap when it does not exist": {
+			crlConfig: &v1alpha2.VaultCRLConfig{
+				ConfigMapRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "crl-configmap"},
+					Key:                  crlKey,
+				},
+			},
+		},
+		"updates an existing ConfigMap": {
+			crlConfig: &v1alpha2.VaultCRLConfig{
+				ConfigMapRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "crl-configmap"},
+					Key:                  crlKey,
+				},
+			},
+			existingObject: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "crl-configmap"},
+				BinaryData: map[string][]byte{crlKey: []byte("stale")},
+			},
+		},
+		"propagates a fetch error from vault": {
+			crlConfig: &v1alpha2.VaultCRLConfig{
+				SecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "crl-secret"},
+					Key:                  crlKey,
+				},
+			},
+			fetchErr: fmt.Errorf("vault is unreachable"),
+			wantErr:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var objects []runtime.Object
+			if test.existingObject != nil {
+				objects = append(objects, test.existingObject.(runtime.Object))
+			}
+
+			kubeClient := k8sfake.NewSimpleClientset(objects...)
+			vault := &fakeInterface{crl: crl, fetchErr: test.fetchErr}
+
+			c := NewRevocationController(kubeClient, "ns", issuerWithCRLConfig(test.crlConfig), vault, nil)
+
+			err := c.refreshCRL()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.wantNoop {
+				if len(vault.revokedSerials) != 0 {
+					t.Errorf("refreshCRL() unexpectedly revoked certificates: %v", vault.revokedSerials)
+				}
+				return
+			}
+
+			switch {
+			case test.crlConfig.SecretRef.Name != "":
+				secret, err := kubeClient.CoreV1().Secrets("ns").Get(test.crlConfig.SecretRef.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("expected CRL secret to exist: %s", err)
+				}
+				if string(secret.Data[crlKey]) != string(crl) {
+					t.Errorf("CRL secret data = %q, want %q", secret.Data[crlKey], crl)
+				}
+			case test.crlConfig.ConfigMapRef.Name != "":
+				configMap, err := kubeClient.CoreV1().ConfigMaps("ns").Get(test.crlConfig.ConfigMapRef.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("expected CRL configmap to exist: %s", err)
+				}
+				if string(configMap.BinaryData[crlKey]) != string(crl) {
+					t.Errorf("CRL configmap data = %q, want %q", configMap.BinaryData[crlKey], crl)
+				}
+			}
+		})
+	}
+}
+
+func TestRevokeCertificateRequest(t *testing.T) {
+	tests := map[string]struct {
+		revokeErr error
+		wantErr   bool
+	}{
+		"revokes the given serial in vault": {},
+		"propagates a revoke error from vault": {
+			revokeErr: fmt.Errorf("vault rejected the revoke request"),
+			wantErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			vault := &fakeInterface{revokeErr: test.revokeErr}
+			c := NewRevocationController(k8sfake.NewSimpleClientset(), "ns", issuerWithCRLConfig(nil), vault, nil)
+
+			err := c.RevokeCertificateRequest("aa:bb:cc")
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(vault.revokedSerials) != 1 || vault.revokedSerials[0] != "aa:bb:cc" {
+				t.Errorf("Revoke called with serials %v, want [\"aa:bb:cc\"]", vault.revokedSerials)
+			}
+		})
+	}
+}
+
+func TestSerialFromCertificateRequest(t *testing.T) {
+	certPEM := generateTestCertificatePEM(t, big.NewInt(0xdeadbeef))
+
+	t.Run("reads the serial from an issued certificate", func(t *testing.T) {
+		cr := &v1alpha2.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: "cr-1"},
+			Status:     v1alpha2.CertificateRequestStatus{Certificate: certPEM},
+		}
+
+		got, err := serialFromCertificateRequest(cr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want := formatSerial(big.NewInt(0xdeadbeef))
+		if got != want {
+			t.Errorf("serialFromCertificateRequest() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("returns an empty serial for a CertificateRequest with no issued certificate", func(t *testing.T) {
+		cr := &v1alpha2.CertificateRequest{ObjectMeta: metav1.ObjectMeta{Name: "cr-2"}}
+
+		got, err := serialFromCertificateRequest(cr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "" {
+			t.Errorf("serialFromCertificateRequest() = %q, want empty string", got)
+		}
+	})
+
+	t.Run("errors on a malformed certificate", func(t *testing.T) {
+		cr := &v1alpha2.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: "cr-3"},
+			Status:     v1alpha2.CertificateRequestStatus{Certificate: []byte("not a pem certificate")},
+		}
+
+		if _, err := serialFromCertificateRequest(cr); err == nil {
+			t.Error("expected an error for a malformed certificate, got nil")
+		}
+	})
+}
+
+func TestFormatSerial(t *testing.T) {
+	tests := map[string]struct {
+		serial *big.Int
+		want   string
+	}{
+		"single byte":    {serial: big.NewInt(0x0a), want: "0a"},
+		"multiple bytes": {serial: big.NewInt(0xdeadbeef), want: "de:ad:be:ef"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := formatSerial(test.serial)
+			if got != test.want {
+				t.Errorf("formatSerial(%v) = %q, want %q", test.serial, got, test.want)
+			}
+		})
+	}
+}
+
+func generateTestCertificatePEM(t *testing.T, serial *big.Int) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
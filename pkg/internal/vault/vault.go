@@ -17,29 +17,66 @@ limitations under the License.
 package vault
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/helper/certutil"
+	corev1 "k8s.io/api/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
 
 	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
 	"github.com/jetstack/cert-manager/pkg/util/pki"
 )
 
+// defaultKubernetesServiceAccountTokenPath is where the ServiceAccount token
+// is projected by kubelet for every pod by default. It is used as the
+// fallback source of the JWT used for Vault's Kubernetes auth method when no
+// explicit secretRef or serviceAccountTokenPath is configured.
+const defaultKubernetesServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// tokenExpiryLeeway is subtracted from the lease duration returned by Vault
+// so that we refresh the cached client token shortly before it actually
+// expires, rather than racing the exact expiry instant.
+const tokenExpiryLeeway = 10 * time.Second
+
 var _ Interface = &Vault{}
 
 type VaultClientBuilder func(namespace string, secretsLister corelisters.SecretLister,
 	issuer v1alpha2.GenericIssuer) (Interface, error)
 
+// DefaultClientBuilder is the VaultClientBuilder the issuer controller uses
+// to construct its Vault client. Swapping it only affects Vault clients
+// constructed in the current process, so it is not a usable seam from a
+// ginkgo e2e test: those run against a controller-manager that is already
+// running as a separate process for the whole suite. Tests that want to
+// exercise Vault issuance without a live Vault server should instead build
+// a Vault Interface directly with NewWithClient and fake.New (see
+// pkg/internal/vault/fake), as pkg/internal/vault's own integration test
+// does, rather than relying on this variable.
+var DefaultClientBuilder VaultClientBuilder = New
+
 type Interface interface {
 	Sign(csrPEM []byte, duration time.Duration) (certPEM []byte, caPEM []byte, err error)
+	// Revoke calls Vault's revoke endpoint for the PKI mount backing this
+	// issuer, marking the certificate with the given serial number (in
+	// colon-separated hex, as printed on the issued certificate) as revoked.
+	Revoke(serial string) error
+	// FetchCRL returns the current DER-encoded CRL published by the PKI
+	// mount backing this issuer.
+	FetchCRL() ([]byte, error)
+	// Tidy triggers Vault's tidy operation on the PKI mount backing this
+	// issuer, removing expired certificates from the mount's storage.
+	Tidy() error
 	Sys() *vault.Sys
 }
 
@@ -57,8 +94,24 @@ type Vault struct {
 	namespace     string
 
 	client Client
+
+	// tokenMu guards tokenExpiry and the token cached on client, since a
+	// single Vault is shared across goroutines: RevocationController's
+	// ticker-driven CRL refresh and its CertificateRequest-delete handler
+	// both call through ensureToken concurrently.
+	tokenMu sync.Mutex
+
+	// tokenExpiry is the time at which the cached client token should be
+	// considered stale and renewed. It is the zero value when the token's
+	// lease duration is unknown (e.g. a static TokenSecretRef), in which
+	// case the token is never refreshed automatically.
+	tokenExpiry time.Time
 }
 
+// New builds a Vault issuer backed by a real Vault server, and is the
+// default VaultClientBuilder used by the issuer controller. Tests that need
+// to exercise issuance without a live Vault should use NewWithClient with a
+// fake Client instead (see pkg/internal/vault/fake).
 func New(namespace string, secretsLister corelisters.SecretLister,
 	issuer v1alpha2.GenericIssuer) (Interface, error) {
 	v := &Vault{
@@ -77,31 +130,76 @@ func New(namespace string, secretsLister corelisters.SecretLister,
 		return nil, fmt.Errorf("error initializing Vault client: %s", err.Error())
 	}
 
+	return NewWithClient(namespace, secretsLister, issuer, client)
+}
+
+// NewWithClient builds a Vault issuer around an already-constructed Client,
+// skipping the real Vault HTTP client setup performed by New. This is the
+// seam tests use to inject a fake Client.
+func NewWithClient(namespace string, secretsLister corelisters.SecretLister,
+	issuer v1alpha2.GenericIssuer, client Client) (Interface, error) {
+	v := &Vault{
+		secretsLister: secretsLister,
+		namespace:     namespace,
+		issuer:        issuer,
+		client:        client,
+	}
+
 	if err := v.setToken(client); err != nil {
 		return nil, err
 	}
 
-	v.client = client
-
 	return v, nil
 }
 
+// signParameters are the Vault PKI sign role parameters Sign derives from
+// the CSR and requested duration. Vault.AdditionalParameters may not
+// override any of these: doing so would mean Vault signs something other
+// than the CSR cert-manager actually generated.
+var signParameters = map[string]struct{}{
+	"common_name":          {},
+	"alt_names":            {},
+	"ip_sans":              {},
+	"uri_sans":             {},
+	"other_sans":           {},
+	"ttl":                  {},
+	"csr":                  {},
+	"exclude_cn_from_sans": {},
+}
+
 func (v *Vault) Sign(csrPEM []byte, duration time.Duration) (cert []byte, ca []byte, err error) {
+	if err := v.ensureToken(); err != nil {
+		return nil, nil, err
+	}
+
 	csr, err := pki.DecodeX509CertificateRequestBytes(csrPEM)
 	if err != nil {
 		return nil, nil, fmt.Errorf("faild to decode CSR for signing: %s", err)
 	}
 
+	// other_sans is formatted by pki.OtherNameStringsFromExtensions as
+	// "oid;utf8:value", the encoding Vault's PKI secrets engine expects for
+	// OtherName SANs (e.g. a SPIFFE UPN stuffed into the SAN extension).
 	parameters := map[string]string{
 		"common_name": csr.Subject.CommonName,
 		"alt_names":   strings.Join(csr.DNSNames, ","),
 		"ip_sans":     strings.Join(pki.IPAddressesToString(csr.IPAddresses), ","),
+		"uri_sans":    strings.Join(pki.URIsToString(csr.URIs), ","),
+		"other_sans":  strings.Join(pki.OtherNameStringsFromExtensions(csr.Extensions), ","),
 		"ttl":         duration.String(),
 		"csr":         string(csrPEM),
 
 		"exclude_cn_from_sans": "true",
 	}
 
+	for k, val := range v.issuer.GetSpec().Vault.AdditionalParameters {
+		if _, reserved := signParameters[k]; reserved {
+			klog.Errorf("ignoring additionalParameter %q for issuer %q: it collides with a parameter cert-manager sets from the CSR", k, v.issuer.GetObjectMeta().Name)
+			continue
+		}
+		parameters[k] = val
+	}
+
 	url := path.Join("/v1", v.issuer.GetSpec().Vault.Path)
 
 	request := v.client.NewRequest("POST", url)
@@ -141,6 +239,23 @@ func (v *Vault) Sign(csrPEM []byte, duration time.Duration) (cert []byte, ca []b
 	return []byte(bundle.ToPEMBundle()), caPem, nil
 }
 
+// ensureToken refreshes the cached client token if it is about to expire.
+// Tokens obtained from methods that do not report a lease duration (for
+// example a static TokenSecretRef) are never refreshed here. Safe to call
+// concurrently: a single Vault is shared by RevocationController's CRL
+// refresh ticker and its CertificateRequest-delete handler, which each run
+// on their own goroutine.
+func (v *Vault) ensureToken() error {
+	v.tokenMu.Lock()
+	defer v.tokenMu.Unlock()
+
+	if v.tokenExpiry.IsZero() || time.Now().Before(v.tokenExpiry) {
+		return nil
+	}
+
+	return v.setToken(v.client)
+}
+
 func (v *Vault) setToken(client Client) error {
 	tokenRef := v.issuer.GetSpec().Vault.Auth.TokenSecretRef
 	if tokenRef.Name != "" {
@@ -149,44 +264,123 @@ func (v *Vault) setToken(client Client) error {
 			return err
 		}
 		client.SetToken(token)
+		v.tokenExpiry = time.Time{}
 
 		return nil
 	}
 
 	appRole := v.issuer.GetSpec().Vault.Auth.AppRole
 	if appRole.RoleId != "" {
-		token, err := v.requestTokenWithAppRoleRef(client, &appRole)
+		token, leaseDuration, err := v.requestTokenWithAppRoleRef(client, &appRole)
 		if err != nil {
 			return err
 		}
 		client.SetToken(token)
+		v.tokenExpiry = expiryFromLeaseDuration(leaseDuration)
 
 		return nil
 	}
 
-	return fmt.Errorf("error initializing Vault client tokenSecretRef or appRoleSecretRef not set")
+	kubernetesAuth := v.issuer.GetSpec().Vault.Auth.Kubernetes
+	if kubernetesAuth != nil && kubernetesAuth.Role != "" {
+		token, leaseDuration, err := v.requestTokenWithKubernetesAuth(client, kubernetesAuth)
+		if err != nil {
+			return err
+		}
+		client.SetToken(token)
+		v.tokenExpiry = expiryFromLeaseDuration(leaseDuration)
+
+		return nil
+	}
+
+	tlsAuth := v.issuer.GetSpec().Vault.Auth.TLS
+	if tlsAuth != nil {
+		token, leaseDuration, err := v.requestTokenWithTLSAuth(client, tlsAuth)
+		if err != nil {
+			return err
+		}
+		client.SetToken(token)
+		v.tokenExpiry = expiryFromLeaseDuration(leaseDuration)
+
+		return nil
+	}
+
+	return fmt.Errorf("error initializing Vault client tokenSecretRef, appRoleSecretRef, kubernetes or tls auth not set")
+}
+
+// expiryFromLeaseDuration returns the zero time.Time when leaseDuration is
+// non-positive (the login response did not report a lease, so the token
+// should not be proactively refreshed), otherwise the time at which the
+// token should be considered stale.
+func expiryFromLeaseDuration(leaseDuration time.Duration) time.Time {
+	if leaseDuration <= tokenExpiryLeeway {
+		return time.Time{}
+	}
+
+	return time.Now().Add(leaseDuration - tokenExpiryLeeway)
 }
 
 func (v *Vault) newConfig() (*vault.Config, error) {
 	cfg := vault.DefaultConfig()
 	cfg.Address = v.issuer.GetSpec().Vault.Server
 
+	transport := cfg.HttpClient.Transport.(*http.Transport)
+
 	certs := v.issuer.GetSpec().Vault.CABundle
-	if len(certs) == 0 {
-		return cfg, nil
-	}
+	if len(certs) > 0 {
+		caCertPool := x509.NewCertPool()
+		ok := caCertPool.AppendCertsFromPEM(certs)
+		if ok == false {
+			return nil, fmt.Errorf("error loading Vault CA bundle")
+		}
 
-	caCertPool := x509.NewCertPool()
-	ok := caCertPool.AppendCertsFromPEM(certs)
-	if ok == false {
-		return nil, fmt.Errorf("error loading Vault CA bundle")
+		transport.TLSClientConfig.RootCAs = caCertPool
 	}
 
-	cfg.HttpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = caCertPool
+	clientCert := v.issuer.GetSpec().Vault.ClientCertificate
+	if clientCert != nil && clientCert.SecretName != "" {
+		cert, err := v.clientCertificateKeyPair(clientCert)
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		if clientCert.ServerName != "" {
+			transport.TLSClientConfig.ServerName = clientCert.ServerName
+		}
+	}
 
 	return cfg, nil
 }
 
+// clientCertificateKeyPair loads the PEM-encoded certificate and private key
+// referenced by clientCert from a "kubernetes.io/tls"-shaped Secret (keys
+// "tls.crt" and "tls.key"), for use as the client certificate in mutual TLS
+// handshakes against Vault.
+func (v *Vault) clientCertificateKeyPair(clientCert *v1alpha2.VaultClientCertificate) (tls.Certificate, error) {
+	secret, err := v.secretsLister.Secrets(v.namespace).Get(clientCert.SecretName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certData, ok := secret.Data[corev1.TLSCertKey]
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("no data for %q in secret '%s/%s'", corev1.TLSCertKey, v.namespace, clientCert.SecretName)
+	}
+
+	keyData, ok := secret.Data[corev1.TLSPrivateKeyKey]
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("no data for %q in secret '%s/%s'", corev1.TLSPrivateKeyKey, v.namespace, clientCert.SecretName)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading Vault client certificate keypair: %s", err.Error())
+	}
+
+	return cert, nil
+}
+
 func (v *Vault) tokenRef(name, namespace, key string) (string, error) {
 	secret, err := v.secretsLister.Secrets(namespace).Get(name)
 	if err != nil {
@@ -229,10 +423,10 @@ func (v *Vault) appRoleRef(appRole *v1alpha2.VaultAppRole) (roleId, secretId str
 	return roleId, secretId, nil
 }
 
-func (v *Vault) requestTokenWithAppRoleRef(client Client, appRole *v1alpha2.VaultAppRole) (string, error) {
+func (v *Vault) requestTokenWithAppRoleRef(client Client, appRole *v1alpha2.VaultAppRole) (string, time.Duration, error) {
 	roleId, secretId, err := v.appRoleRef(appRole)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	parameters := map[string]string{
@@ -251,12 +445,12 @@ func (v *Vault) requestTokenWithAppRoleRef(client Client, appRole *v1alpha2.Vaul
 
 	err = request.SetJSONBody(parameters)
 	if err != nil {
-		return "", fmt.Errorf("error encoding Vault parameters: %s", err.Error())
+		return "", 0, fmt.Errorf("error encoding Vault parameters: %s", err.Error())
 	}
 
 	resp, err := client.RawRequest(request)
 	if err != nil {
-		return "", fmt.Errorf("error logging in to Vault server: %s", err.Error())
+		return "", 0, fmt.Errorf("error logging in to Vault server: %s", err.Error())
 	}
 
 	defer resp.Body.Close()
@@ -264,21 +458,223 @@ func (v *Vault) requestTokenWithAppRoleRef(client Client, appRole *v1alpha2.Vaul
 	vaultResult := vault.Secret{}
 	resp.DecodeJSON(&vaultResult)
 	if err != nil {
-		return "", fmt.Errorf("unable to decode JSON payload: %s", err.Error())
+		return "", 0, fmt.Errorf("unable to decode JSON payload: %s", err.Error())
 	}
 
 	token, err := vaultResult.TokenID()
 	if err != nil {
-		return "", fmt.Errorf("unable to read token: %s", err.Error())
+		return "", 0, fmt.Errorf("unable to read token: %s", err.Error())
 	}
 
 	if token == "" {
-		return "", errors.New("no token returned")
+		return "", 0, errors.New("no token returned")
 	}
 
-	return token, nil
+	return token, leaseDuration(&vaultResult), nil
+}
+
+// kubernetesServiceAccountJWT resolves the JWT used to authenticate against
+// Vault's Kubernetes auth method, preferring an explicit SecretRef (for a
+// token copied into a Secret) and otherwise reading the JWT from a mounted
+// ServiceAccount token file, such as one projected by a service-mesh
+// sidecar or kubelet itself.
+func (v *Vault) kubernetesServiceAccountJWT(kubernetesAuth *v1alpha2.VaultKubernetesAuth) (string, error) {
+	if kubernetesAuth.SecretRef.Name != "" {
+		return v.tokenRef(kubernetesAuth.SecretRef.Name, v.namespace, kubernetesAuth.SecretRef.Key)
+	}
+
+	tokenPath := kubernetesAuth.ServiceAccountTokenPath
+	if tokenPath == "" {
+		tokenPath = defaultKubernetesServiceAccountTokenPath
+	}
+
+	jwt, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading Kubernetes ServiceAccount token from %q: %s", tokenPath, err.Error())
+	}
+
+	return strings.TrimSpace(string(jwt)), nil
+}
+
+func (v *Vault) requestTokenWithKubernetesAuth(client Client, kubernetesAuth *v1alpha2.VaultKubernetesAuth) (string, time.Duration, error) {
+	jwt, err := v.kubernetesServiceAccountJWT(kubernetesAuth)
+	if err != nil {
+		return "", 0, err
+	}
+
+	parameters := map[string]string{
+		"jwt":  jwt,
+		"role": kubernetesAuth.Role,
+	}
+
+	authPath := kubernetesAuth.Path
+	if authPath == "" {
+		authPath = "kubernetes"
+	}
+
+	url := path.Join("/v1", "auth", authPath, "login")
+
+	request := client.NewRequest("POST", url)
+
+	err = request.SetJSONBody(parameters)
+	if err != nil {
+		return "", 0, fmt.Errorf("error encoding Vault parameters: %s", err.Error())
+	}
+
+	resp, err := client.RawRequest(request)
+	if err != nil {
+		return "", 0, fmt.Errorf("error logging in to Vault server: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	vaultResult := vault.Secret{}
+	resp.DecodeJSON(&vaultResult)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to decode JSON payload: %s", err.Error())
+	}
+
+	token, err := vaultResult.TokenID()
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read token: %s", err.Error())
+	}
+
+	if token == "" {
+		return "", 0, errors.New("no token returned")
+	}
+
+	return token, leaseDuration(&vaultResult), nil
+}
+
+// requestTokenWithTLSAuth logs in to Vault's TLS certificate auth method.
+// The client certificate presented during the TLS handshake (configured via
+// Vault.ClientCertificate/newConfig) is what Vault actually authenticates;
+// this request just exchanges that handshake for a Vault token.
+func (v *Vault) requestTokenWithTLSAuth(client Client, tlsAuth *v1alpha2.VaultTLSAuth) (string, time.Duration, error) {
+	parameters := map[string]string{}
+	if tlsAuth.Name != "" {
+		parameters["name"] = tlsAuth.Name
+	}
+
+	authPath := tlsAuth.Path
+	if authPath == "" {
+		authPath = "cert"
+	}
+
+	url := path.Join("/v1", "auth", authPath, "login")
+
+	request := client.NewRequest("POST", url)
+
+	if err := request.SetJSONBody(parameters); err != nil {
+		return "", 0, fmt.Errorf("error encoding Vault parameters: %s", err.Error())
+	}
+
+	resp, err := client.RawRequest(request)
+	if err != nil {
+		return "", 0, fmt.Errorf("error logging in to Vault server: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	vaultResult := vault.Secret{}
+	resp.DecodeJSON(&vaultResult)
+
+	token, err := vaultResult.TokenID()
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read token: %s", err.Error())
+	}
+
+	if token == "" {
+		return "", 0, errors.New("no token returned")
+	}
+
+	return token, leaseDuration(&vaultResult), nil
+}
+
+// leaseDuration returns the auth lease duration reported by Vault, or zero
+// if the secret has no auth block (e.g. it came from a legacy server).
+func leaseDuration(secret *vault.Secret) time.Duration {
+	if secret == nil || secret.Auth == nil {
+		return 0
+	}
+
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second
 }
 
 func (v *Vault) Sys() *vault.Sys {
 	return v.client.Sys()
 }
+
+// mount returns the PKI secrets engine mount point backing this issuer,
+// which is the first path segment of Vault.Path (e.g. "pki" for a Path of
+// "pki/sign/example-dot-com").
+func (v *Vault) mount() string {
+	return strings.SplitN(v.issuer.GetSpec().Vault.Path, "/", 2)[0]
+}
+
+func (v *Vault) Revoke(serial string) error {
+	if err := v.ensureToken(); err != nil {
+		return err
+	}
+
+	parameters := map[string]string{
+		"serial_number": serial,
+	}
+
+	url := path.Join("/v1", v.mount(), "revoke")
+
+	request := v.client.NewRequest("POST", url)
+
+	if err := request.SetJSONBody(parameters); err != nil {
+		return fmt.Errorf("failed to build vault request: %s", err.Error())
+	}
+
+	resp, err := v.client.RawRequest(request)
+	if err != nil {
+		return fmt.Errorf("failed to revoke certificate %q in vault: %s", serial, err.Error())
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (v *Vault) FetchCRL() ([]byte, error) {
+	if err := v.ensureToken(); err != nil {
+		return nil, err
+	}
+
+	url := path.Join("/v1", v.mount(), "crl")
+
+	request := v.client.NewRequest("GET", url)
+
+	resp, err := v.client.RawRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch CRL from vault: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	crl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRL response body: %s", err.Error())
+	}
+
+	return crl, nil
+}
+
+func (v *Vault) Tidy() error {
+	if err := v.ensureToken(); err != nil {
+		return err
+	}
+
+	url := path.Join("/v1", v.mount(), "tidy")
+
+	request := v.client.NewRequest("POST", url)
+
+	resp, err := v.client.RawRequest(request)
+	if err != nil {
+		return fmt.Errorf("failed to trigger vault tidy: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// package vault_test (rather than vault) is required here so this file can
+// import pkg/internal/vault/fake, which itself imports pkg/internal/vault -
+// an import cycle if this lived in the internal test package.
+package vault_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	internalvault "github.com/jetstack/cert-manager/pkg/internal/vault"
+	"github.com/jetstack/cert-manager/pkg/internal/vault/fake"
+)
+
+// TestSignWithFakeClient exercises Vault issuance end-to-end against
+// pkg/internal/vault/fake's in-process CA: AppRole login, then a PKI sign
+// request, both serviced over the same NewRequest/RawRequest path a real
+// Vault client uses. This is the integration point the vault e2e suite's
+// now-removed DefaultClientBuilder swap never actually reached (it only
+// ever affected the test binary's own process, not the separately-running
+// controller-manager a real CertificateRequest e2e test talks to); it is
+// also what caught fake.Client.NewRequest shipping a nil URL, which
+// RawRequest's call to vault.Request.ToHTTP panics on for every request.
+func TestSignWithFakeClient(t *testing.T) {
+	secretName := "vault-approle-secret"
+	secretsLister := newFakeSecretLister(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: secretName},
+		Data:       map[string][]byte{"secretId": []byte("fake-secret-id")},
+	})
+
+	issuer := &v1alpha2.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "fake-vault-issuer"},
+		Spec: v1alpha2.IssuerSpec{
+			IssuerConfig: v1alpha2.IssuerConfig{
+				Vault: &v1alpha2.VaultIssuer{
+					Server: "https://fake-vault.invalid",
+					Path:   "pki/sign/example-dot-com",
+					Auth: v1alpha2.VaultAuth{
+						AppRole: v1alpha2.VaultAppRole{
+							Path:   "approle",
+							RoleId: "fake-role-id",
+							SecretRef: cmmeta.SecretKeySelector{
+								LocalObjectReference: cmmeta.LocalObjectReference{Name: secretName},
+								Key:                  "secretId",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	fakeClient, err := fake.New()
+	if err != nil {
+		t.Fatalf("failed to construct fake vault client: %s", err)
+	}
+
+	v, err := internalvault.NewWithClient("ns", secretsLister, issuer, fakeClient)
+	if err != nil {
+		t.Fatalf("failed to construct Vault issuer: %s", err)
+	}
+
+	csrPEM := generateTestCSRPEM(t)
+
+	certPEM, caPEM, err := v.Sign(csrPEM, time.Hour*24*90)
+	if err != nil {
+		t.Fatalf("unexpected error from Sign: %s", err)
+	}
+
+	if block, _ := pem.Decode(certPEM); block == nil {
+		t.Errorf("Sign() returned a certificate that does not PEM-decode: %q", certPEM)
+	}
+	if block, _ := pem.Decode(caPEM); block == nil {
+		t.Errorf("Sign() returned a CA certificate that does not PEM-decode: %q", caPEM)
+	}
+}
+
+// TestSignIgnoresReservedAdditionalParameters guards against a regression
+// where a misconfigured issuer's AdditionalParameters could silently
+// override a built-in parameter Sign derives from the CSR - in particular
+// "csr" itself, which would mean Vault signs something other than the CSR
+// cert-manager actually generated. It sets AdditionalParameters["csr"] to
+// garbage that would fail to parse as a CSR were it ever sent; Sign
+// succeeding, against the fake CA's real CSR-decoding sign handler, shows
+// the override was ignored rather than applied.
+func TestSignIgnoresReservedAdditionalParameters(t *testing.T) {
+	secretName := "vault-approle-secret"
+	secretsLister := newFakeSecretLister(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: secretName},
+		Data:       map[string][]byte{"secretId": []byte("fake-secret-id")},
+	})
+
+	issuer := &v1alpha2.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "fake-vault-issuer"},
+		Spec: v1alpha2.IssuerSpec{
+			IssuerConfig: v1alpha2.IssuerConfig{
+				Vault: &v1alpha2.VaultIssuer{
+					Server: "https://fake-vault.invalid",
+					Path:   "pki/sign/example-dot-com",
+					Auth: v1alpha2.VaultAuth{
+						AppRole: v1alpha2.VaultAppRole{
+							Path:   "approle",
+							RoleId: "fake-role-id",
+							SecretRef: cmmeta.SecretKeySelector{
+								LocalObjectReference: cmmeta.LocalObjectReference{Name: secretName},
+								Key:                  "secretId",
+							},
+						},
+					},
+					AdditionalParameters: map[string]string{
+						"csr":       "not a csr",
+						"other_key": "passthrough",
+					},
+				},
+			},
+		},
+	}
+
+	fakeClient, err := fake.New()
+	if err != nil {
+		t.Fatalf("failed to construct fake vault client: %s", err)
+	}
+
+	v, err := internalvault.NewWithClient("ns", secretsLister, issuer, fakeClient)
+	if err != nil {
+		t.Fatalf("failed to construct Vault issuer: %s", err)
+	}
+
+	csrPEM := generateTestCSRPEM(t)
+
+	certPEM, _, err := v.Sign(csrPEM, time.Hour*24*90)
+	if err != nil {
+		t.Fatalf("Sign() returned an error, meaning the reserved \"csr\" additionalParameter was applied instead of ignored: %s", err)
+	}
+	if block, _ := pem.Decode(certPEM); block == nil {
+		t.Errorf("Sign() returned a certificate that does not PEM-decode: %q", certPEM)
+	}
+}
+
+func generateTestCSRPEM(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %s", err)
+	}
+
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "integration-test"}}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("failed to create test CSR: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+}
+
+func newFakeSecretLister(t *testing.T, secrets ...*corev1.Secret) corelisters.SecretLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, s := range secrets {
+		if err := indexer.Add(s); err != nil {
+			t.Fatalf("failed to seed fake secret lister: %s", err)
+		}
+	}
+	return corelisters.NewSecretLister(indexer)
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha2"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+)
+
+// fakeAuthClient is a minimal Client double for exercising setToken's login
+// branches without a real Vault server. NewRequest records the path it was
+// asked to build a request for; RawRequest ignores the request it's handed
+// and returns the canned response body, regardless of which login endpoint
+// the caller thinks it's hitting.
+type fakeAuthClient struct {
+	token string
+
+	respBody     string
+	requestPaths []string
+}
+
+func (f *fakeAuthClient) NewRequest(method, requestPath string) *vaultapi.Request {
+	f.requestPaths = append(f.requestPaths, requestPath)
+	return &vaultapi.Request{Method: method}
+}
+
+func (f *fakeAuthClient) RawRequest(_ *vaultapi.Request) (*vaultapi.Response, error) {
+	return &vaultapi.Response{Response: &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(f.respBody)),
+	}}, nil
+}
+
+func (f *fakeAuthClient) SetToken(v string)  { f.token = v }
+func (f *fakeAuthClient) Token() string      { return f.token }
+func (f *fakeAuthClient) Sys() *vaultapi.Sys { return nil }
+
+// newFakeSecretLister returns a corelisters.SecretLister backed by an
+// in-memory indexer seeded with secrets, for tests that need v.secretsLister
+// without a real API server.
+func newFakeSecretLister(t *testing.T, secrets ...*corev1.Secret) corelisters.SecretLister {
+	t.Helper()
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, s := range secrets {
+		if err := indexer.Add(s); err != nil {
+			t.Fatalf("failed to seed fake secret lister: %s", err)
+		}
+	}
+
+	return corelisters.NewSecretLister(indexer)
+}
+
+func TestExpiryFromLeaseDuration(t *testing.T) {
+	tests := map[string]struct {
+		leaseDuration time.Duration
+		wantZero      bool
+	}{
+		"zero lease duration is never refreshed":                      {leaseDuration: 0, wantZero: true},
+		"lease duration shorter than the leeway is never refreshed":   {leaseDuration: 5 * time.Second, wantZero: true},
+		"lease duration equal to the leeway is never refreshed":       {leaseDuration: tokenExpiryLeeway, wantZero: true},
+		"lease duration comfortably longer than the leeway refreshes": {leaseDuration: time.Hour, wantZero: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			before := time.Now()
+			got := expiryFromLeaseDuration(test.leaseDuration)
+
+			if test.wantZero {
+				if !got.IsZero() {
+					t.Errorf("expiryFromLeaseDuration(%s) = %v, want zero time", test.leaseDuration, got)
+				}
+				return
+			}
+
+			wantNotBefore := before.Add(test.leaseDuration - tokenExpiryLeeway)
+			if got.Before(wantNotBefore) {
+				t.Errorf("expiryFromLeaseDuration(%s) = %v, want at least %v", test.leaseDuration, got, wantNotBefore)
+			}
+			if got.After(before.Add(test.leaseDuration)) {
+				t.Errorf("expiryFromLeaseDuration(%s) = %v, want at most %v", test.leaseDuration, got, before.Add(test.leaseDuration))
+			}
+		})
+	}
+}
+
+func TestKubernetesServiceAccountJWT(t *testing.T) {
+	t.Run("prefers an explicit secretRef over the mounted token file", func(t *testing.T) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "k8s-jwt-secret"},
+			Data:       map[string][]byte{"token": []byte(" from-secret \n")},
+		}
+		v := &Vault{namespace: "ns", secretsLister: newFakeSecretLister(t, secret)}
+
+		got, err := v.kubernetesServiceAccountJWT(&v1alpha2.VaultKubernetesAuth{
+			Role: "my-role",
+			SecretRef: cmmeta.SecretKeySelector{
+				LocalObjectReference: cmmeta.LocalObjectReference{Name: "k8s-jwt-secret"},
+				Key:                  "token",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "from-secret" {
+			t.Errorf("kubernetesServiceAccountJWT() = %q, want %q", got, "from-secret")
+		}
+	})
+
+	t.Run("falls back to reading a mounted ServiceAccount token file", func(t *testing.T) {
+		v := &Vault{namespace: "ns", secretsLister: newFakeSecretLister(t)}
+
+		dir := t.TempDir()
+		tokenPath := filepath.Join(dir, "token")
+		if err := os.WriteFile(tokenPath, []byte("from-file\n"), 0600); err != nil {
+			t.Fatalf("failed to write fixture token file: %s", err)
+		}
+
+		got, err := v.kubernetesServiceAccountJWT(&v1alpha2.VaultKubernetesAuth{
+			Role:                    "my-role",
+			ServiceAccountTokenPath: tokenPath,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "from-file" {
+			t.Errorf("kubernetesServiceAccountJWT() = %q, want %q", got, "from-file")
+		}
+	})
+}
+
+const fakeLoginResponse = `{"auth":{"client_token":"fake-token","lease_duration":3600,"renewable":true}}`
+
+// TestSetTokenPrecedence asserts setToken tries TokenSecretRef, AppRole,
+// Kubernetes and TLS auth in that order, stopping at the first one
+// configured on the issuer.
+func TestSetTokenPrecedence(t *testing.T) {
+	tokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "token-secret"},
+		Data:       map[string][]byte{"token": []byte("static-token")},
+	}
+	appRoleSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "approle-secret"},
+		Data:       map[string][]byte{"secretId": []byte("approle-secret-id")},
+	}
+	k8sJWTSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "k8s-jwt-secret"},
+		Data:       map[string][]byte{"token": []byte("k8s-jwt")},
+	}
+
+	tests := map[string]struct {
+		auth            v1alpha2.VaultAuth
+		wantToken       string
+		wantRequestPath string
+	}{
+		"token secret ref short-circuits without calling vault": {
+			auth: v1alpha2.VaultAuth{
+				TokenSecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "token-secret"},
+					Key:                  "token",
+				},
+			},
+			wantToken: "static-token",
+		},
+		"app role is used when no token secret ref is set": {
+			auth: v1alpha2.VaultAuth{
+				AppRole: v1alpha2.VaultAppRole{
+					RoleId: "role-id",
+					SecretRef: cmmeta.SecretKeySelector{
+						LocalObjectReference: cmmeta.LocalObjectReference{Name: "approle-secret"},
+						Key:                  "secretId",
+					},
+				},
+			},
+			wantToken:       "fake-token",
+			wantRequestPath: "/v1/auth/approle/login",
+		},
+		"kubernetes is used when no token secret ref or app role is set": {
+			auth: v1alpha2.VaultAuth{
+				Kubernetes: &v1alpha2.VaultKubernetesAuth{
+					Role: "my-role",
+					SecretRef: cmmeta.SecretKeySelector{
+						LocalObjectReference: cmmeta.LocalObjectReference{Name: "k8s-jwt-secret"},
+						Key:                  "token",
+					},
+				},
+			},
+			wantToken:       "fake-token",
+			wantRequestPath: "/v1/auth/kubernetes/login",
+		},
+		"tls is used when nothing else is set": {
+			auth: v1alpha2.VaultAuth{
+				TLS: &v1alpha2.VaultTLSAuth{Name: "my-cert-role"},
+			},
+			wantToken:       "fake-token",
+			wantRequestPath: "/v1/auth/cert/login",
+		},
+		"token secret ref wins even if app role is also set": {
+			auth: v1alpha2.VaultAuth{
+				TokenSecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: cmmeta.LocalObjectReference{Name: "token-secret"},
+					Key:                  "token",
+				},
+				AppRole: v1alpha2.VaultAppRole{
+					RoleId: "role-id",
+					SecretRef: cmmeta.SecretKeySelector{
+						LocalObjectReference: cmmeta.LocalObjectReference{Name: "approle-secret"},
+						Key:                  "secretId",
+					},
+				},
+			},
+			wantToken: "static-token",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := &Vault{
+				namespace:     "ns",
+				secretsLister: newFakeSecretLister(t, tokenSecret, appRoleSecret, k8sJWTSecret),
+				issuer: &v1alpha2.Issuer{
+					Spec: v1alpha2.IssuerSpec{
+						IssuerConfig: v1alpha2.IssuerConfig{
+							Vault: &v1alpha2.VaultIssuer{Auth: test.auth},
+						},
+					},
+				},
+			}
+
+			client := &fakeAuthClient{respBody: fakeLoginResponse}
+
+			if err := v.setToken(client); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if client.token != test.wantToken {
+				t.Errorf("setToken() set token %q, want %q", client.token, test.wantToken)
+			}
+
+			if test.wantRequestPath == "" {
+				if len(client.requestPaths) != 0 {
+					t.Errorf("setToken() made unexpected requests: %v", client.requestPaths)
+				}
+				return
+			}
+
+			if len(client.requestPaths) != 1 || client.requestPaths[0] != test.wantRequestPath {
+				t.Errorf("setToken() made requests %v, want a single request to %q", client.requestPaths, test.wantRequestPath)
+			}
+		})
+	}
+}
+
+// TestEnsureTokenConcurrent exercises ensureToken from many goroutines at
+// once against a single shared Vault, the way RevocationController's CRL
+// refresh ticker and its CertificateRequest-delete handler both call
+// through it on their own goroutines. Run with -race: before tokenMu was
+// added, this reliably tripped the race detector on tokenExpiry.
+func TestEnsureTokenConcurrent(t *testing.T) {
+	appRoleSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "approle-secret"},
+		Data:       map[string][]byte{"secretId": []byte("approle-secret-id")},
+	}
+
+	v := &Vault{
+		namespace:     "ns",
+		secretsLister: newFakeSecretLister(t, appRoleSecret),
+		issuer: &v1alpha2.Issuer{
+			Spec: v1alpha2.IssuerSpec{
+				IssuerConfig: v1alpha2.IssuerConfig{
+					Vault: &v1alpha2.VaultIssuer{
+						Auth: v1alpha2.VaultAuth{
+							AppRole: v1alpha2.VaultAppRole{
+								RoleId: "role-id",
+								SecretRef: cmmeta.SecretKeySelector{
+									LocalObjectReference: cmmeta.LocalObjectReference{Name: "approle-secret"},
+									Key:                  "secretId",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		client:      &fakeAuthClient{respBody: fakeLoginResponse},
+		tokenExpiry: time.Now().Add(-time.Second),
+	}
+
+	const goroutines = 20
+	errs := make(chan error, goroutines)
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			errs <- v.ensureToken()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error from ensureToken: %s", err)
+		}
+	}
+}
+
+// TestClientCertificateKeyPair asserts the mTLS client certificate is
+// loaded from the "tls.crt"/"tls.key" keys of the referenced Secret.
+func TestClientCertificateKeyPair(t *testing.T) {
+	certPEM, keyPEM := generateTestKeyPair(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "client-cert-secret"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+
+	v := &Vault{namespace: "ns", secretsLister: newFakeSecretLister(t, secret)}
+
+	cert, err := v.clientCertificateKeyPair(&v1alpha2.VaultClientCertificate{SecretName: "client-cert-secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cert.Certificate) == 0 {
+		t.Errorf("clientCertificateKeyPair() returned a certificate with no DER data")
+	}
+
+	t.Run("missing secret key is an error", func(t *testing.T) {
+		missingKeySecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "missing-key-secret"},
+			Data:       map[string][]byte{corev1.TLSCertKey: certPEM},
+		}
+		v := &Vault{namespace: "ns", secretsLister: newFakeSecretLister(t, missingKeySecret)}
+
+		if _, err := v.clientCertificateKeyPair(&v1alpha2.VaultClientCertificate{SecretName: "missing-key-secret"}); err == nil {
+			t.Error("expected an error for a secret missing tls.key, got nil")
+		}
+	})
+}
+
+func generateTestKeyPair(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %s", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return certPEM, keyPEM
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pki
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net/url"
+)
+
+// oidSubjectAltName is the X.509 Subject Alternative Name extension OID.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// otherNameGeneralName mirrors the ASN.1 OtherName production of
+// GeneralName (RFC 5280 section 4.2.1.6):
+//
+//	OtherName ::= SEQUENCE {
+//	    type-id    OBJECT IDENTIFIER,
+//	    value      [0] EXPLICIT ANY DEFINED BY type-id }
+type otherNameGeneralName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// URIsToString renders a list of URI SANs in the string form Vault's PKI
+// secrets engine expects for its uri_sans role parameter.
+func URIsToString(uris []*url.URL) []string {
+	var out []string
+	for _, u := range uris {
+		if u == nil {
+			continue
+		}
+		out = append(out, u.String())
+	}
+	return out
+}
+
+// OtherNameStringsFromExtensions walks a CSR's extensions for the Subject
+// Alternative Name extension and returns its OtherName entries formatted as
+// "oid;utf8:value", the encoding Vault's PKI secrets engine expects for its
+// other_sans role parameter.
+func OtherNameStringsFromExtensions(extensions []pkix.Extension) []string {
+	var out []string
+
+	for _, ext := range extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+
+		out = append(out, otherNameStringsFromSANExtension(ext.Value)...)
+	}
+
+	return out
+}
+
+func otherNameStringsFromSANExtension(value []byte) []string {
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(value, &seq); err != nil {
+		return nil
+	}
+	if seq.Class != asn1.ClassUniversal || seq.Tag != asn1.TagSequence || !seq.IsCompound {
+		return nil
+	}
+
+	var out []string
+
+	rest := seq.Bytes
+	for len(rest) > 0 {
+		var generalName asn1.RawValue
+
+		var err error
+		rest, err = asn1.Unmarshal(rest, &generalName)
+		if err != nil {
+			return out
+		}
+
+		// otherName is GeneralName's [0] IMPLICIT alternative; other
+		// alternatives (rfc822Name, dNSName, ...) are skipped here as the
+		// caller already handles them via csr.DNSNames/csr.IPAddresses/
+		// csr.URIs.
+		if generalName.Class != asn1.ClassContextSpecific || generalName.Tag != 0 {
+			continue
+		}
+
+		formatted, ok := formatOtherName(generalName.Bytes)
+		if ok {
+			out = append(out, formatted)
+		}
+	}
+
+	return out
+}
+
+func formatOtherName(otherNameContent []byte) (string, bool) {
+	// otherNameContent holds the content octets of an IMPLICIT [0]-tagged
+	// OtherName SEQUENCE; re-wrap them with the universal SEQUENCE tag so
+	// asn1.Unmarshal can decode it into otherNameGeneralName.
+	seq, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSequence,
+		IsCompound: true,
+		Bytes:      otherNameContent,
+	})
+	if err != nil {
+		return "", false
+	}
+
+	var on otherNameGeneralName
+	if _, err := asn1.Unmarshal(seq, &on); err != nil {
+		return "", false
+	}
+
+	// The "explicit,tag:0" struct tag only strips the explicit wrapper;
+	// on.Value.Bytes still holds the inner element's own TLV encoding
+	// (e.g. a UTF8String), so unmarshal once more to get at its content.
+	var inner asn1.RawValue
+	if _, err := asn1.Unmarshal(on.Value.Bytes, &inner); err != nil {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s;utf8:%s", on.TypeID.String(), string(inner.Bytes)), true
+}
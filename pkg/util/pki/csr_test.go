@@ -0,0 +1,108 @@
+/*
+Copyright 2019 The Jetstack cert-manager contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// buildOtherNameSANExtension builds a SAN extension value containing a
+// single OtherName general name, matching the ASN.1 shape real CSRs (e.g. a
+// SPIFFE/UPN-style identity) embed in their Subject Alternative Name
+// extension. The nested implicit/explicit tags in GeneralName's OtherName
+// choice aren't representable with asn1.Marshal's struct tags (it passes
+// asn1.RawValue fields through verbatim, ignoring "explicit"/"tag"
+// params on them), so this is assembled by hand from TLV-encoded pieces.
+func buildOtherNameSANExtension(t *testing.T, oid asn1.ObjectIdentifier, value string) []byte {
+	t.Helper()
+
+	oidTLV, err := asn1.Marshal(oid)
+	if err != nil {
+		t.Fatalf("failed to marshal OID: %s", err)
+	}
+
+	utf8TLV, err := asn1.MarshalWithParams(value, "utf8")
+	if err != nil {
+		t.Fatalf("failed to marshal UTF8String value: %s", err)
+	}
+
+	explicitValue := wrapTLV(0xa0, utf8TLV) // value [0] EXPLICIT ANY
+	otherNameContent := append(append([]byte{}, oidTLV...), explicitValue...)
+	generalName := wrapTLV(0xa0, otherNameContent) // otherName [0] IMPLICIT OtherName
+	return wrapTLV(0x30, generalName)              // GeneralNames ::= SEQUENCE OF GeneralName
+}
+
+// wrapTLV prepends a tag and short-form length to content. Test fixtures
+// here are all well under 128 bytes, so long-form lengths are never needed.
+func wrapTLV(tag byte, content []byte) []byte {
+	return append([]byte{tag, byte(len(content))}, content...)
+}
+
+func TestOtherNameStringsFromExtensions(t *testing.T) {
+	upnOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+	const upnValue = "user@example.com"
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %s", err)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:    oidSubjectAltName,
+				Value: buildOtherNameSANExtension(t, upnOID, upnValue),
+			},
+		},
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to create test CSR: %s", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatalf("failed to parse test CSR: %s", err)
+	}
+
+	got := OtherNameStringsFromExtensions(csr.Extensions)
+	want := []string{"1.3.6.1.4.1.311.20.2.3;utf8:user@example.com"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OtherNameStringsFromExtensions() = %#v, want %#v", got, want)
+	}
+}
+
+func TestURIsToString(t *testing.T) {
+	a, err := url.Parse("spiffe://foo.foo.example.net")
+	if err != nil {
+		t.Fatalf("failed to parse test URI: %s", err)
+	}
+
+	got := URIsToString([]*url.URL{a, nil})
+	want := []string{"spiffe://foo.foo.example.net"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("URIsToString() = %#v, want %#v", got, want)
+	}
+}